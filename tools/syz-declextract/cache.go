@@ -0,0 +1,173 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/syzkaller/pkg/tool"
+)
+
+// extractCache is a content-addressed, on-disk cache of worker output. It is keyed on
+// the extractor binary, the compile command used for a translation unit, and that TU's
+// dependency set, so that an incremental rerun (e.g. after a single kernel source file
+// changes) only needs to re-invoke the extractor binary for the affected TUs.
+type extractCache struct {
+	dir string
+}
+
+// newExtractCache creates a cache rooted at dir, or returns nil (a no-op cache) if dir
+// is empty, i.e. caching is disabled.
+func newExtractCache(dir string) *extractCache {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tool.Fail(err)
+	}
+	return &extractCache{dir: dir}
+}
+
+// binaryFingerprint identifies a build of the extractor binary, so that rebuilding it
+// invalidates every cache entry keyed against the previous build.
+func binaryFingerprint(binary string) (string, error) {
+	fi, err := os.Stat(binary)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%d", filepath.Base(binary), fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// key computes a content-addressed cache key for extracting file, compiled with args
+// from the compile command's directory, under the given extractor binary fingerprint.
+func (c *extractCache) key(binFingerprint string, args []string, directory, file string) string {
+	h := sha256.New()
+	fmt.Fprintln(h, binFingerprint)
+	fmt.Fprintln(h, file)
+	for _, arg := range args {
+		fmt.Fprintln(h, arg)
+	}
+	for _, dep := range dependencies(directory, file, args) {
+		fmt.Fprintln(h, dep.name, dep.modTime)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type dependency struct {
+	name    string
+	modTime int64
+}
+
+// dependencies returns the files a translation unit depends on: the TU itself plus the
+// compiler's own dependency list (obtained via -M), since a header-only change must also
+// invalidate the cache. Compile commands commonly use paths relative to directory
+// rather than this process's cwd, so each candidate is resolved against directory (via
+// resolveSourcePath) before it's stat'd; candidates that cannot be stat'd are skipped.
+func dependencies(directory, file string, args []string) []dependency {
+	headers := append(headerList(directory, file, args), file)
+	deps := make([]dependency, 0, len(headers))
+	for _, h := range headers {
+		fi, err := os.Stat(resolveSourcePath(directory, h))
+		if err != nil {
+			continue
+		}
+		deps = append(deps, dependency{h, fi.ModTime().UnixNano()})
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].name < deps[j].name })
+	return deps
+}
+
+// headerList asks the compiler invoked by args, run from directory (as the original
+// compile command was), for the translation unit's included headers via -M. It returns
+// nil if that fails, e.g. because args does not describe a compatible compiler
+// invocation.
+func headerList(directory, file string, args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	cmdArgs := append(append([]string{}, args[1:]...), "-M", "-MT", "_")
+	cmd := exec.Command(args[0], cmdArgs...)
+	cmd.Dir = directory
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	var headers []string
+	for _, f := range strings.Fields(strings.ReplaceAll(string(out), "\\\n", " ")) {
+		if f == "_:" || f == file {
+			continue
+		}
+		headers = append(headers, f)
+	}
+	return headers
+}
+
+func (c *extractCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+type cacheEntry struct {
+	Stdout string
+	Stderr string
+}
+
+// load returns the cached output for key, if present.
+func (c *extractCache) load(key string) (output, bool) {
+	if c == nil {
+		return output{}, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return output{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return output{}, false
+	}
+	// file is left zero here; the caller (worker) fills it in, since the cache
+	// itself is keyed content-addressed and has no notion of "the" file for a key.
+	return output{stdout: entry.Stdout, stderr: entry.Stderr}, true
+}
+
+// store writes out under key. Failed extractions (out.stderr != "") are not cached, so
+// that the next run retries them.
+func (c *extractCache) store(key string, out output) {
+	if c == nil || out.stderr != "" {
+		return
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	data, err := json.Marshal(cacheEntry{out.stdout, out.stderr})
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0644)
+}
+
+// prune removes every cache entry whose key is not in keep.
+func (c *extractCache) prune(keep map[string]bool) error {
+	if c == nil {
+		return nil
+	}
+	return filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !keep[d.Name()] {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
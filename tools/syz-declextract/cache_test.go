@@ -0,0 +1,153 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCompiler writes a shell stub standing in for a real compiler's -M output: given
+// "-M -MT _ ...", it prints a fixed dependency line naming headers relative to the
+// directory it's run from, the same way a real compile command's -M output does.
+func fakeCompiler(t *testing.T, headers ...string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake compiler script requires a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "fake-cc.sh")
+	script := "#!/bin/sh\nprintf '_: " + strings.Join(headers, " ") + "\\n'\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake compiler: %v", err)
+	}
+	return path
+}
+
+func TestExtractCacheRoundTrip(t *testing.T) {
+	cache := newExtractCache(t.TempDir())
+	key := "deadbeef"
+	want := output{stdout: "some syzkaller decls", stderr: ""}
+
+	if _, ok := cache.load(key); ok {
+		t.Fatalf("load before store: got a hit, want a miss")
+	}
+
+	cache.store(key, want)
+
+	got, ok := cache.load(key)
+	if !ok {
+		t.Fatalf("load after store: got a miss, want a hit")
+	}
+	if got.stdout != want.stdout || got.stderr != want.stderr {
+		t.Fatalf("load after store: got %+v, want %+v", got, want)
+	}
+}
+
+func TestExtractCacheDoesNotStoreFailures(t *testing.T) {
+	cache := newExtractCache(t.TempDir())
+	key := "deadbeef"
+
+	cache.store(key, output{stdout: "partial", stderr: "boom"})
+
+	if _, ok := cache.load(key); ok {
+		t.Fatalf("load after storing a failure: got a hit, want a miss")
+	}
+}
+
+func TestNilExtractCacheIsNoop(t *testing.T) {
+	var cache *extractCache
+
+	if _, ok := cache.load("anything"); ok {
+		t.Fatalf("load on a nil cache: got a hit, want a miss")
+	}
+	cache.store("anything", output{stdout: "x"}) // must not panic
+	if err := cache.prune(nil); err != nil {
+		t.Fatalf("prune on a nil cache: got %v, want nil", err)
+	}
+}
+
+func TestExtractCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	cache := newExtractCache(dir)
+
+	cache.store("keep", output{stdout: "keep me"})
+	cache.store("drop", output{stdout: "drop me"})
+
+	if err := cache.prune(map[string]bool{"keep": true}); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	if _, ok := cache.load("keep"); !ok {
+		t.Fatalf("load(keep) after prune: got a miss, want a hit")
+	}
+	if _, ok := cache.load("drop"); ok {
+		t.Fatalf("load(drop) after prune: got a hit, want a miss")
+	}
+}
+
+// TestHeaderListRunsFromDirectory guards against the -M invocation resolving headers
+// against this process's cwd instead of the compile command's own directory, which is
+// what real compile_commands.json entries (paths relative to Directory) require.
+func TestHeaderListRunsFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "foo.h"), nil, 0644); err != nil {
+		t.Fatalf("writing foo.h: %v", err)
+	}
+	compiler := fakeCompiler(t, "foo.c", "foo.h")
+
+	headers := headerList(dir, "foo.c", []string{compiler, "-c", "foo.c"})
+	want := []string{"foo.h"}
+	if !slices.Equal(headers, want) {
+		t.Fatalf("headerList = %v, want %v", headers, want)
+	}
+}
+
+// TestDependenciesResolvesAgainstDirectory guards the other half of the same bug: even
+// given a correct header list, dependencies must stat each header relative to directory,
+// not the process cwd, or every header mtime lookup fails and the cache key silently
+// stops tracking header changes.
+func TestDependenciesResolvesAgainstDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "foo.h"), nil, 0644); err != nil {
+		t.Fatalf("writing foo.h: %v", err)
+	}
+	compiler := fakeCompiler(t, "foo.c", "foo.h")
+	args := []string{compiler, "-c", "foo.c"}
+
+	deps := dependencies(dir, "foo.c", args)
+	if len(deps) != 1 || deps[0].name != "foo.h" {
+		t.Fatalf("dependencies = %+v, want a single foo.h entry", deps)
+	}
+}
+
+// TestKeyChangesWithDependencyMtime is the end-to-end version of the two tests above: a
+// cache key must change when a relative-path header is touched, since that's the whole
+// point of hashing dependency mtimes in the first place.
+func TestKeyChangesWithDependencyMtime(t *testing.T) {
+	dir := t.TempDir()
+	header := filepath.Join(dir, "foo.h")
+	if err := os.WriteFile(header, nil, 0644); err != nil {
+		t.Fatalf("writing foo.h: %v", err)
+	}
+	compiler := fakeCompiler(t, "foo.c", "foo.h")
+	args := []string{compiler, "-c", "foo.c"}
+	cache := newExtractCache(t.TempDir())
+
+	before := cache.key("bin-v1", args, dir, "foo.c")
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(header, later, later); err != nil {
+		t.Fatalf("touching foo.h: %v", err)
+	}
+
+	after := cache.key("bin-v1", args, dir, "foo.c")
+	if before == after {
+		t.Fatalf("key did not change after foo.h's mtime changed: got %q both times", before)
+	}
+}
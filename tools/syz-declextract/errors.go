@@ -0,0 +1,103 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+// failureTailLines bounds how much of a failed TU's stderr/stdout is kept in the
+// failure report, so one pathological TU can't blow up the report size.
+const failureTailLines = 20
+
+// failure is one TU's extraction failure, as recorded in the --errors report.
+type failure struct {
+	File           string   `json:"file"`
+	CompileCommand []string `json:"compile_command"`
+	ExitCode       int      `json:"exit_code"`
+	StderrTail     string   `json:"stderr_tail"`
+	Classification string   `json:"classification"`
+	// Benign marks failures that are expected on a tree that hasn't been fully
+	// built yet (e.g. a missing generated header), so CI can diff the report
+	// against an allowlist instead of treating every failure as a regression.
+	Benign bool `json:"benign"`
+}
+
+// classifyFailure builds a failure record for file from its worker output, guessing a
+// coarse classification from the stderr text.
+func classifyFailure(file string, cmd compileCommand, out output) *failure {
+	class, benign := classify(out.stderr)
+	return &failure{
+		File:           file,
+		CompileCommand: cmd.Arguments,
+		ExitCode:       out.exitCode,
+		StderrTail:     tail(out.stderr, failureTailLines),
+		Classification: class,
+		Benign:         benign,
+	}
+}
+
+// generatedHeaderPatterns are substrings found in the path of a header the kernel build
+// itself produces (e.g. via "make prepare"), rather than one checked into the tree, so a
+// missing-header failure naming one of them is expected on a tree that hasn't been built
+// yet. Any other missing header - a typo'd #include, a header actually removed - is a
+// real regression and must not be classified as benign.
+var generatedHeaderPatterns = []string{
+	"generated/",
+	"include/config/",
+}
+
+// classify guesses a coarse failure category from stderr, and whether the failure is
+// expected on a kernel tree that hasn't been fully built yet.
+func classify(stderr string) (class string, benign bool) {
+	switch {
+	case strings.Contains(stderr, "No such file or directory"), strings.Contains(stderr, "file not found"):
+		return "missing header", isGeneratedHeaderMiss(stderr)
+	case strings.Contains(stderr, "Segmentation fault"), strings.Contains(stderr, "signal: "):
+		return "AST extractor crashed", false
+	case strings.Contains(stderr, "error:"):
+		return "parse error", false
+	default:
+		return "unknown", false
+	}
+}
+
+// isGeneratedHeaderMiss reports whether a "missing header" stderr names a path matching
+// generatedHeaderPatterns.
+func isGeneratedHeaderMiss(stderr string) bool {
+	for _, pattern := range generatedHeaderPatterns {
+		if strings.Contains(stderr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// tail returns at most the last n lines of s.
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeErrorReport writes the current set of failures to path as JSON, sorted by file
+// for a stable diff against an allowlist.
+func (e *extraction) writeErrorReport(path string) error {
+	failures := make([]*failure, 0, len(e.failures))
+	for _, f := range e.failures {
+		failures = append(failures, f)
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].File < failures[j].File })
+
+	data, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
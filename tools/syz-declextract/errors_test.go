@@ -0,0 +1,86 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		stderr     string
+		wantClass  string
+		wantBenign bool
+	}{
+		{"fatal error: include/generated/autoconf.h: No such file or directory", "missing header", true},
+		{"fatal error: include/config/auto.conf: file not found", "missing header", true},
+		// A path outside generatedHeaderPatterns is a real missing header (typo'd
+		// #include, header actually removed), not a pre-build artifact.
+		{"fatal error: linux/foo.h: No such file or directory", "missing header", false},
+		{"clang: error: file not found", "missing header", false},
+		{"Segmentation fault (core dumped)", "AST extractor crashed", false},
+		{"signal: killed", "AST extractor crashed", false},
+		{"foo.c:12:3: error: expected ';'", "parse error", false},
+		{"something went sideways", "unknown", false},
+	}
+	for _, test := range tests {
+		class, benign := classify(test.stderr)
+		if class != test.wantClass || benign != test.wantBenign {
+			t.Errorf("classify(%q) = (%q, %v), want (%q, %v)",
+				test.stderr, class, benign, test.wantClass, test.wantBenign)
+		}
+	}
+}
+
+func TestTail(t *testing.T) {
+	s := "a\nb\nc\nd\ne\n"
+	if got := tail(s, 2); got != "d\ne" {
+		t.Errorf("tail(%q, 2) = %q, want %q", s, got, "d\ne")
+	}
+	if got := tail(s, 10); got != "a\nb\nc\nd\ne" {
+		t.Errorf("tail(%q, 10) = %q, want %q", s, got, "a\nb\nc\nd\ne")
+	}
+}
+
+func TestWriteErrorReportSortedByFile(t *testing.T) {
+	e := &extraction{
+		failures: map[string]*failure{
+			"b.c": classifyFailure("b.c", compileCommand{}, output{stderr: "error: bad"}),
+			"a.c": classifyFailure("a.c", compileCommand{}, output{stderr: "include/generated/autoconf.h: No such file or directory"}),
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "errors.json")
+	if err := e.writeErrorReport(path); err != nil {
+		t.Fatalf("writeErrorReport: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	var failures []failure
+	if err := json.Unmarshal(data, &failures); err != nil {
+		t.Fatalf("unmarshaling report: %v", err)
+	}
+	if len(failures) != 2 {
+		t.Fatalf("len(failures) = %d, want 2", len(failures))
+	}
+	if failures[0].File != "a.c" || failures[1].File != "b.c" {
+		t.Fatalf("failures not sorted by file: got %q, %q", failures[0].File, failures[1].File)
+	}
+	if !failures[0].Benign {
+		t.Errorf("a.c: got Benign = false, want true (missing header)")
+	}
+	if failures[1].Benign {
+		t.Errorf("b.c: got Benign = true, want false (parse error)")
+	}
+	if !strings.Contains(failures[0].Classification, "missing header") {
+		t.Errorf("a.c: got Classification %q, want it to mention missing header", failures[0].Classification)
+	}
+}
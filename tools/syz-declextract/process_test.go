@@ -0,0 +1,73 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+)
+
+// fakeExtractorScript writes a shell stub standing in for the real syz-declextract
+// binary: given "-p db file", it prints "include <file>" after an artificial delay for
+// files whose name contains "slow", so that the slow file's worker reliably finishes
+// after faster ones - regardless of queue position - exercising the race that process
+// must handle correctly.
+func fakeExtractorScript(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake extractor script requires a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "fake-extractor.sh")
+	script := "#!/bin/sh\nfile=\"$3\"\ncase \"$file\" in\n  *slow*) sleep 0.2 ;;\nesac\nprintf 'include <%s>\\n' \"$file\"\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake extractor: %v", err)
+	}
+	return path
+}
+
+// TestProcessAttributesOutputByFile guards against pairing a worker's output with the
+// wrong file when results arrive out of enqueue order, which happens whenever more than
+// one file is in flight - guaranteed once the extraction cache (see cache.go) lets some
+// lookups return instantly while others take full compile time.
+func TestProcessAttributesOutputByFile(t *testing.T) {
+	binary := fakeExtractorScript(t)
+
+	files := []string{"slow.c", "fast1.c", "fast2.c", "fast3.c"}
+	cmdsByFile := make(map[string]compileCommand, len(files))
+	for _, f := range files {
+		cmdsByFile[f] = compileCommand{File: f}
+	}
+
+	e := &extraction{
+		binary:         binary,
+		cmdsByFile:     cmdsByFile,
+		syscallNames:   map[string][]string{},
+		nodesByFile:    make(map[string][]ast.Node, len(files)),
+		failures:       make(map[string]*failure),
+		subsystemRules: defaultSubsystemRules,
+	}
+	// Enqueue the slow file first: a consumer loop that pairs channel-arrival order
+	// with enqueue order would attribute a fast file's output to it.
+	e.process(files)
+
+	for _, f := range files {
+		nodes, ok := e.nodesByFile[f]
+		if !ok || len(nodes) == 0 {
+			t.Fatalf("nodesByFile[%q]: got none, want an include node", f)
+		}
+		include, ok := nodes[0].(*ast.Include)
+		if !ok {
+			t.Fatalf("nodesByFile[%q][0]: got %T, want *ast.Include", f, nodes[0])
+		}
+		if include.File.Value != f {
+			t.Fatalf("nodesByFile[%q]: got include for %q, output was attributed to the wrong file",
+				f, include.File.Value)
+		}
+	}
+}
+
@@ -33,8 +33,10 @@ type compileCommand struct {
 }
 
 type output struct {
-	stdout string
-	stderr string
+	file     string
+	stdout   string
+	stderr   string
+	exitCode int
 }
 
 func main() {
@@ -42,10 +44,29 @@ func main() {
 	binary := flag.String("binary", "syz-declextract", "path to binary")
 	outFile := flag.String("output", "out.txt", "output file")
 	kernelDir := flag.String("kernel", "", "kernel directory")
+	cacheDir := flag.String("cache", "", "directory for the content-addressed extraction cache (disabled if empty)")
+	force := flag.Bool("force", false, "bypass the extraction cache and reprocess every file")
+	prune := flag.Bool("prune", false, "remove cache entries not referenced by the current compilation database, then exit")
+	watch := flag.Bool("watch", false, "after the initial run, watch the kernel source tree and re-extract on change")
+	split := flag.String("split", "single", "output split mode: single (one output file) or subsystem (one file per kernel subsystem)")
+	subsystemMap := flag.String("subsystem_map", "", "optional JSON file of path-prefix->subsystem overrides for --split=subsystem")
+	errorsPath := flag.String("errors", "", "path to write a structured JSON failure report (disabled if empty)")
+	failFast := flag.Bool("fail_fast", false, "abort the whole run on the first extraction failure instead of collecting a failure report")
 	flag.Parse()
 	if *kernelDir == "" {
 		tool.Failf("path to kernel directory is required")
 	}
+	if *split != splitSingle && *split != splitSubsystem {
+		tool.Failf("-split must be %q or %q", splitSingle, splitSubsystem)
+	}
+	subsystemRules := defaultSubsystemRules
+	if *subsystemMap != "" {
+		overrides, err := loadSubsystemOverrides(*subsystemMap)
+		if err != nil {
+			tool.Fail(err)
+		}
+		subsystemRules = append(overrides, subsystemRules...)
+	}
 
 	fileData, err := os.ReadFile(*compilationDatabase)
 	if err != nil {
@@ -57,40 +78,164 @@ func main() {
 		tool.Fail(err)
 	}
 
-	outputs := make(chan output, len(cmds))
-	files := make(chan string, len(cmds))
-	for w := 0; w < runtime.NumCPU(); w++ {
-		go worker(outputs, files, *binary, *compilationDatabase)
+	cache := newExtractCache(*cacheDir)
+	binFingerprint, err := binaryFingerprint(*binary)
+	if err != nil {
+		tool.Fail(err)
 	}
-
+	cmdsByFile := make(map[string]compileCommand, len(cmds))
 	for _, v := range cmds {
-		files <- v.File
+		cmdsByFile[v.File] = v
 	}
 
-	var syscalls []*ast.Call
-	var netlinks []*ast.Struct
-	var includes []*ast.Include
-	var typeDefs []*ast.TypeDef
-	var resources []*ast.Resource
-	syscallNames := readSyscallNames(filepath.Join(*kernelDir, "arch"))
-	// Some syscalls have different names and entry points and thus need to be renamed.
-	// e.g. SYSCALL_DEFINE1(setuid16, old_uid_t, uid) is referred to in the .tbl file with setuid.
+	if *prune {
+		if cache != nil {
+			keep := make(map[string]bool, len(cmds))
+			for _, v := range cmds {
+				keep[cache.key(binFingerprint, v.Arguments, v.Directory, v.File)] = true
+			}
+			if err := cache.prune(keep); err != nil {
+				tool.Fail(err)
+			}
+		}
+		return
+	}
+
+	e := &extraction{
+		binary:              *binary,
+		compilationDatabase: *compilationDatabase,
+		cmdsByFile:          cmdsByFile,
+		cache:               cache,
+		binFingerprint:      binFingerprint,
+		force:               *force,
+		// Some syscalls have different names and entry points and thus need to be renamed.
+		// e.g. SYSCALL_DEFINE1(setuid16, old_uid_t, uid) is referred to in the .tbl file with setuid.
+		syscallNames:   readSyscallNames(filepath.Join(*kernelDir, "arch")),
+		nodesByFile:    make(map[string][]ast.Node, len(cmds)),
+		split:          *split,
+		subsystemRules: subsystemRules,
+		failFast:       *failFast,
+		failures:       make(map[string]*failure),
+	}
+
+	allFiles := make([]string, len(cmds))
+	for i, v := range cmds {
+		allFiles[i] = v.File
+	}
+	e.process(allFiles)
+	e.writeOutput(*outFile)
+	if *errorsPath != "" {
+		if err := e.writeErrorReport(*errorsPath); err != nil {
+			tool.Fail(err)
+		}
+	}
+
+	if *watch {
+		if err := watchAndReextract(e, cmds, *kernelDir, *outFile, *errorsPath); err != nil {
+			tool.Fail(err)
+		}
+	}
+}
+
+// extraction holds the state needed to (re-)extract a set of translation units and
+// stitch their ASTs into a single output file. It is reused across the initial full
+// run and, in --watch mode, every subsequent incremental rerun.
+type extraction struct {
+	binary              string
+	compilationDatabase string
+	cmdsByFile          map[string]compileCommand
+	cache               *extractCache
+	binFingerprint      string
+	force               bool
+	syscallNames        map[string][]string
+
+	// split selects how writeOutput lays out its result: splitSingle (one
+	// monolithic file, the historical behavior) or splitSubsystem (one file per
+	// kernel subsystem, see subsystem.go).
+	split          string
+	subsystemRules []subsystemRule
+
+	// nodesByFile holds the parsed AST nodes produced for each file's translation
+	// unit, which also serves as that file's provenance for --split=subsystem.
+	// Reprocessing a file replaces its entry, so stitching the output back
+	// together never has to deduplicate across reruns.
+	nodesByFile map[string][]ast.Node
+
+	// failFast makes process abort the whole run on the first extraction failure,
+	// instead of recording it in failures and moving on.
+	failFast bool
+	// failures holds the current failure, if any, for every file that has ever
+	// been processed. A later successful rerun of a file (--watch) clears its
+	// entry, so the report always reflects the latest attempt.
+	failures map[string]*failure
+}
+
+// process (re-)extracts files, updating e.nodesByFile. A TU that fails to extract or
+// parse is recorded in e.failures and otherwise skipped, unless e.failFast is set, in
+// which case the run aborts immediately.
+func (e *extraction) process(files []string) {
+	outputs := make(chan output, len(files))
+	pending := make(chan string, len(files))
+	for w := 0; w < runtime.NumCPU(); w++ {
+		go worker(outputs, pending, e.binary, e.compilationDatabase, e.cmdsByFile, e.cache, e.binFingerprint, e.force)
+	}
+	for _, file := range files {
+		pending <- file
+	}
+	close(pending)
 
 	eh := ast.LoggingHandler
-	for range cmds {
+	// Workers complete in whatever order their extraction or cache lookup finishes in,
+	// not the order files were enqueued in (guaranteed once some lookups are cache hits
+	// and others aren't), so each output must be attributed to the file it names rather
+	// than to the next file in the original slice.
+	for range files {
 		out := <-outputs
+		file := out.file
 		if out.stderr != "" {
-			tool.Failf("%s", out.stderr)
+			if e.failFast {
+				tool.Failf("%s", out.stderr)
+			}
+			e.failures[file] = classifyFailure(file, e.cmdsByFile[file], out)
+			continue
 		}
 		parse := ast.Parse([]byte(out.stdout), "", eh)
 		if parse == nil {
-			fmt.Println(out.stdout)
-			tool.Failf("parsing error")
+			if e.failFast {
+				fmt.Println(out.stdout)
+				tool.Failf("parsing error")
+			}
+			e.failures[file] = &failure{
+				File:           file,
+				CompileCommand: e.cmdsByFile[file].Arguments,
+				Classification: "parse error",
+				StderrTail:     tail(out.stdout, failureTailLines),
+			}
+			continue
 		}
-		for _, node := range parse.Nodes {
+		delete(e.failures, file)
+		e.nodesByFile[file] = parse.Nodes
+	}
+}
+
+// writeOutput collects the current per-file nodes, grouped by provenance, and writes
+// the result according to e.split.
+func (e *extraction) writeOutput(outFile string) {
+	if e.split == splitSubsystem {
+		e.writeSubsystemOutput(outFile)
+		return
+	}
+
+	var syscalls []*ast.Call
+	var netlinks []*ast.Struct
+	var includes []*ast.Include
+	var typeDefs []*ast.TypeDef
+	var resources []*ast.Resource
+	for _, nodes := range e.nodesByFile {
+		for _, node := range nodes {
 			switch node := node.(type) {
 			case *ast.Call:
-				syscalls = append(syscalls, renameSyscall(node, syscallNames)...)
+				syscalls = append(syscalls, renameSyscall(node, e.syscallNames)...)
 			case *ast.Struct:
 				netlinks = append(netlinks, node)
 			case *ast.Include:
@@ -104,20 +249,22 @@ func main() {
 			}
 		}
 	}
-
-	close(files)
-	writeOutput(includes, syscalls, netlinks, typeDefs, resources, *outFile)
+	writeOutput(includes, syscalls, netlinks, typeDefs, resources, outFile)
 }
 
-func writeOutput(includes []*ast.Include, syscalls []*ast.Call, netlinks []*ast.Struct, types []*ast.TypeDef,
-	resources []*ast.Resource, outFile string) {
+// sortAndDedupIncludes sorts includes by header path and drops duplicates.
+func sortAndDedupIncludes(includes []*ast.Include) []*ast.Include {
 	slices.SortFunc(includes, func(a, b *ast.Include) int {
 		return strings.Compare(a.File.Value, b.File.Value)
 	})
-	includes = slices.CompactFunc(includes, func(a, b *ast.Include) bool {
+	return slices.CompactFunc(includes, func(a, b *ast.Include) bool {
 		return a.File.Value == b.File.Value
 	})
+}
 
+// sortAndDedupSyscalls sorts syscalls by name (and, for sendmsg, by netlink policy) and
+// collapses syscalls that only differ in argument names.
+func sortAndDedupSyscalls(syscalls []*ast.Call) []*ast.Call {
 	slices.SortFunc(syscalls, func(a, b *ast.Call) int {
 		nameCmp := strings.Compare(a.Name.Name, b.Name.Name)
 		if nameCmp != 0 {
@@ -143,27 +290,41 @@ func writeOutput(includes []*ast.Include, syscalls []*ast.Call, netlinks []*ast.
 		}
 	}
 
-	syscalls = slices.CompactFunc(syscalls, func(a, b *ast.Call) bool {
+	return slices.CompactFunc(syscalls, func(a, b *ast.Call) bool {
 		// We only compare the the system call names for cases where the same system call has different parameter names,
 		// but share the same syzkaller type. NOTE:Change when we have better type extraction.
 		return a.Name.Name == b.Name.Name
 	})
+}
 
+func sortNetlinks(netlinks []*ast.Struct) {
 	slices.SortFunc(netlinks, func(a, b *ast.Struct) int {
 		return strings.Compare(a.Name.Name, b.Name.Name)
 	})
+}
 
+func sortResources(resources []*ast.Resource) {
 	slices.SortFunc(resources, func(a, b *ast.Resource) int {
 		return strings.Compare(a.Name.Name, b.Name.Name)
 	})
+}
 
+func sortTypes(types []*ast.TypeDef) {
 	slices.SortFunc(types, func(a, b *ast.TypeDef) int {
 		return strings.Compare(a.Name.Name, b.Name.Name)
 	})
+}
+
+func writeOutput(includes []*ast.Include, syscalls []*ast.Call, netlinks []*ast.Struct, types []*ast.TypeDef,
+	resources []*ast.Resource, outFile string) {
+	includes = sortAndDedupIncludes(includes)
+	syscalls = sortAndDedupSyscalls(syscalls)
+	sortNetlinks(netlinks)
+	sortResources(resources)
+	sortTypes(types)
 
 	autoGeneratedNotice := "# Code generated by syz-declextract. DO NOT EDIT.\n"
 	commonKernelHeaders := "include <include/vdso/bits.h>\ninclude <include/linux/types.h>"
-	var netlinkNames []string
 	mmap2 := "_ = __NR_mmap2\n"
 	eh := ast.LoggingHandler
 	desc := ast.Parse([]byte(autoGeneratedNotice+commonKernelHeaders), "", eh)
@@ -177,10 +338,30 @@ func writeOutput(includes []*ast.Include, syscalls []*ast.Call, netlinks []*ast.
 		desc.Nodes = append(desc.Nodes, node)
 	}
 	usedNetlink := make(map[string]bool)
+	for _, node := range filterSendmsgPolicies(syscalls, netlinks, usedNetlink) {
+		desc.Nodes = append(desc.Nodes, node)
+	}
+	desc.Nodes = append(desc.Nodes, ast.Parse([]byte(mmap2), "", eh).Nodes...)
+	desc.Nodes = append(desc.Nodes, buildNetlinkUnion(netlinks, usedNetlink)...)
+
+	err := os.WriteFile(outFile, ast.Format(ast.Parse(ast.Format(desc), "", eh)), 0666)
+	// New lines are added in the parsing step. This is why we need to Format (serialize the description), Parse, then
+	// Format again.
+	if err != nil {
+		tool.Fail(err)
+	}
+}
+
+// filterSendmsgPolicies drops sendmsg calls whose netlink policy (msghdr_auto[_, Policy])
+// isn't defined by any struct in netlinks, the same way a policy with no backing struct
+// would otherwise reference an undeclared type. Every policy that IS kept is recorded in
+// used, so buildNetlinkUnion knows which netlinks still need a generic fallback entry.
+func filterSendmsgPolicies(syscalls []*ast.Call, netlinks []*ast.Struct, used map[string]bool) []*ast.Call {
+	var kept []*ast.Call
 	for _, node := range syscalls {
 		if node.CallName == sendmsg && len(node.Args[1].Type.Args) == 2 {
 			policy := node.Args[1].Type.Args[1].Args[1].Ident
-			usedNetlink[policy] = true
+			used[policy] = true
 			_, isDefined := slices.BinarySearchFunc(netlinks, policy, func(a *ast.Struct, b string) int {
 				return strings.Compare(a.Name.Name, b)
 			})
@@ -188,14 +369,21 @@ func writeOutput(includes []*ast.Include, syscalls []*ast.Call, netlinks []*ast.
 				continue
 			}
 		}
-		desc.Nodes = append(desc.Nodes, node)
+		kept = append(kept, node)
 	}
-	desc.Nodes = append(desc.Nodes, ast.Parse([]byte(mmap2), "", eh).Nodes...)
+	return kept
+}
+
+// buildNetlinkUnion synthesizes the msghdr_auto/auto_union/autogenerated_netlink/
+// sendmsg$autorun declarations that let every extracted netlink policy get fuzzed even
+// when filterSendmsgPolicies found no specific sendmsg$<policy> call for it (used tracks
+// which ones already have one). It returns netlinks themselves plus the synthetic nodes,
+// ready to append to a description file's node list.
+func buildNetlinkUnion(netlinks []*ast.Struct, used map[string]bool) []ast.Node {
+	var netlinkNames []string
 	for _, node := range netlinks {
-		desc.Nodes = append(desc.Nodes, node)
-		name := node.Name.Name
-		if !usedNetlink[name] {
-			netlinkNames = append(netlinkNames, name)
+		if !used[node.Name.Name] {
+			netlinkNames = append(netlinkNames, node.Name.Name)
 		}
 	}
 	for i, netlink := range netlinkNames {
@@ -208,33 +396,46 @@ syz_genetlink_get_family_id$auto(name ptr[in, string], fd sock_nl_generic) autog
 sendmsg$autorun(fd sock_nl_generic, msg ptr[in, auto_union], f flags[send_flags])
 auto_union [
 ` + strings.Join(netlinkNames, "") + "]"
-	netlinkUnionParsed := ast.Parse([]byte(netlinkUnion), "", eh)
-	if netlinkUnionParsed == nil {
+	eh := ast.LoggingHandler
+	parsed := ast.Parse([]byte(netlinkUnion), "", eh)
+	if parsed == nil {
 		tool.Failf("parsing error")
 	}
-	desc.Nodes = append(desc.Nodes, netlinkUnionParsed.Nodes...)
-
-	err := os.WriteFile(outFile, ast.Format(ast.Parse(ast.Format(desc), "", eh)), 0666)
-	// New lines are added in the parsing step. This is why we need to Format (serialize the description), Parse, then
-	// Format again.
-	if err != nil {
-		tool.Fail(err)
+	nodes := make([]ast.Node, 0, len(netlinks)+len(parsed.Nodes))
+	for _, node := range netlinks {
+		nodes = append(nodes, node)
 	}
+	return append(nodes, parsed.Nodes...)
 }
 
-func worker(outputs chan output, files chan string, binary, compilationDatabase string) {
+func worker(outputs chan output, files chan string, binary, compilationDatabase string, cmdsByFile map[string]compileCommand,
+	cache *extractCache, binFingerprint string, force bool) {
 	for file := range files {
 		if !strings.HasSuffix(file, ".c") {
-			outputs <- output{}
+			outputs <- output{file: file}
 			continue
 		}
 
+		var key string
+		if cache != nil {
+			key = cache.key(binFingerprint, cmdsByFile[file].Arguments, cmdsByFile[file].Directory, file)
+			if !force {
+				if out, ok := cache.load(key); ok {
+					out.file = file
+					outputs <- out
+					continue
+				}
+			}
+		}
+
 		cmd := exec.Command(binary, "-p", compilationDatabase, file)
 		stdout, err := cmd.Output()
 		var stderr string
+		exitCode := 0
 		if err != nil {
 			var error *exec.ExitError
 			if errors.As(err, &error) {
+				exitCode = error.ExitCode()
 				if len(error.Stderr) != 0 {
 					stderr = string(error.Stderr)
 				} else {
@@ -244,7 +445,11 @@ func worker(outputs chan output, files chan string, binary, compilationDatabase
 				stderr = err.Error()
 			}
 		}
-		outputs <- output{string(stdout), stderr}
+		out := output{file: file, stdout: string(stdout), stderr: stderr, exitCode: exitCode}
+		if cache != nil {
+			cache.store(key, out)
+		}
+		outputs <- out
 	}
 }
 
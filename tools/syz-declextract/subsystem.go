@@ -0,0 +1,272 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/tool"
+)
+
+const (
+	splitSingle    = "single"
+	splitSubsystem = "subsystem"
+
+	// unknownSubsystem is used for TUs that don't match any subsystemRule.
+	unknownSubsystem = "misc"
+	// commonSubsystemFile holds resources/typedefs/includes shared by more than one
+	// subsystem, plus the netlink policy structs and synthesized sendmsg union (see
+	// buildNetlinkUnion). Subsystem files need no explicit reference to it: syzkaller's
+	// description compiler treats every .txt file in a directory as one compilation
+	// unit.
+	commonSubsystemFile = "common_auto.txt"
+)
+
+// subsystemRule maps TUs whose source path has the given prefix to a subsystem name.
+// Rules are tried in list order and the first matching prefix wins;
+// defaultSubsystemRules lists more specific prefixes before more general ones,
+// mirroring how syzkaller's hand-written
+// descriptions are organized by kernel subsystem (net/ipv4 -> ipv4, drivers/net ->
+// drivers_net, etc.).
+type subsystemRule struct {
+	Prefix string
+	Name   string
+}
+
+var defaultSubsystemRules = []subsystemRule{
+	{"net/ipv4/", "ipv4"},
+	{"net/ipv6/", "ipv6"},
+	{"net/netfilter/", "netfilter"},
+	{"net/netlink/", "netlink"},
+	{"net/bluetooth/", "bluetooth"},
+	{"net/wireless/", "wireless"},
+	{"net/", "net"},
+	{"drivers/net/", "drivers_net"},
+	{"drivers/usb/", "usb"},
+	{"drivers/gpu/", "gpu"},
+	{"fs/", "fs"},
+	{"kernel/", "kernel"},
+	{"mm/", "mm"},
+	{"sound/", "sound"},
+}
+
+// loadSubsystemOverrides reads a JSON object of path-prefix -> subsystem name from
+// path, e.g. {"net/ipv4/": "ipv4", "drivers/net/wireless/": "wifi"}. It is merged
+// ahead of defaultSubsystemRules, so an override always wins over the built-in mapping.
+func loadSubsystemOverrides(path string) ([]subsystemRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %v: %w", path, err)
+	}
+	rules := make([]subsystemRule, 0, len(raw))
+	for prefix, name := range raw {
+		rules = append(rules, subsystemRule{prefix, name})
+	}
+	// Longest prefix first, so a more specific override (e.g. drivers/net/wireless/)
+	// is tried before a more general one (e.g. drivers/net/).
+	sort.Slice(rules, func(i, j int) bool { return len(rules[i].Prefix) > len(rules[j].Prefix) })
+	return rules, nil
+}
+
+// subsystemFor returns the subsystem of the first rule in rules whose prefix matches
+// file, or unknownSubsystem if none match. A longer prefix wins only if its rule comes
+// earlier in rules.
+func subsystemFor(file string, rules []subsystemRule) string {
+	for _, rule := range rules {
+		if strings.HasPrefix(file, rule.Prefix) {
+			return rule.Name
+		}
+	}
+	return unknownSubsystem
+}
+
+// subsystemNodes accumulates the nodes belonging to one subsystem's output file.
+type subsystemNodes struct {
+	syscalls  []*ast.Call
+	netlinks  []*ast.Struct
+	includes  []*ast.Include
+	typeDefs  []*ast.TypeDef
+	resources []*ast.Resource
+}
+
+// writeSubsystemOutput groups e.nodesByFile by subsystem (inferred from each TU's
+// source path) and writes one file per subsystem under filepath.Dir(outFile), plus a
+// shared commonSubsystemFile for resources/typedefs/includes that more than one
+// subsystem defines, and for the netlink policy structs and their generated
+// msghdr_auto/auto_union fallback (see buildNetlinkUnion), since a policy a sendmsg call
+// in one subsystem references is frequently defined by a TU in a different one.
+func (e *extraction) writeSubsystemOutput(outFile string) {
+	dir := filepath.Dir(outFile)
+
+	bySubsystem := make(map[string]*subsystemNodes)
+	// definedIn tracks, for every named resource/typedef/include, which subsystems
+	// define a node by that name - anything defined in more than one subsystem is
+	// hoisted into the common file below.
+	definedIn := make(map[string]map[string]bool)
+	mark := func(kind, name, subsystem string) {
+		key := kind + ":" + name
+		if definedIn[key] == nil {
+			definedIn[key] = make(map[string]bool)
+		}
+		definedIn[key][subsystem] = true
+	}
+
+	for file, nodes := range e.nodesByFile {
+		subsystem := subsystemFor(file, e.subsystemRules)
+		ns := bySubsystem[subsystem]
+		if ns == nil {
+			ns = &subsystemNodes{}
+			bySubsystem[subsystem] = ns
+		}
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case *ast.Call:
+				ns.syscalls = append(ns.syscalls, renameSyscall(node, e.syscallNames)...)
+			case *ast.Struct:
+				ns.netlinks = append(ns.netlinks, node)
+			case *ast.Include:
+				ns.includes = append(ns.includes, node)
+				mark("include", node.File.Value, subsystem)
+			case *ast.TypeDef:
+				ns.typeDefs = append(ns.typeDefs, node)
+				mark("typedef", node.Name.Name, subsystem)
+			case *ast.Resource:
+				ns.resources = append(ns.resources, node)
+				mark("resource", node.Name.Name, subsystem)
+			case *ast.NewLine:
+				continue
+			}
+		}
+	}
+
+	shared := func(kind, name string) bool {
+		return len(definedIn[kind+":"+name]) > 1
+	}
+
+	common := &subsystemNodes{}
+	subsystems := make([]string, 0, len(bySubsystem))
+	for subsystem, ns := range bySubsystem {
+		subsystems = append(subsystems, subsystem)
+
+		var keepIncludes []*ast.Include
+		for _, n := range ns.includes {
+			if shared("include", n.File.Value) {
+				common.includes = append(common.includes, n)
+			} else {
+				keepIncludes = append(keepIncludes, n)
+			}
+		}
+		ns.includes = keepIncludes
+
+		var keepTypes []*ast.TypeDef
+		for _, n := range ns.typeDefs {
+			if shared("typedef", n.Name.Name) {
+				common.typeDefs = append(common.typeDefs, n)
+			} else {
+				keepTypes = append(keepTypes, n)
+			}
+		}
+		ns.typeDefs = keepTypes
+
+		var keepResources []*ast.Resource
+		for _, n := range ns.resources {
+			if shared("resource", n.Name.Name) {
+				common.resources = append(common.resources, n)
+			} else {
+				keepResources = append(keepResources, n)
+			}
+		}
+		ns.resources = keepResources
+	}
+	sort.Strings(subsystems)
+
+	// A sendmsg call's netlink policy is frequently defined by a TU in a different
+	// subsystem than the call itself (e.g. a driver's sendmsg referencing a policy
+	// struct that net/netlink's TUs define), so - mirroring how writeOutput treats the
+	// whole TU set as a single pool - gather every extracted policy struct globally
+	// instead of scoping it to whichever subsystem happened to produce it.
+	var allNetlinks []*ast.Struct
+	for _, ns := range bySubsystem {
+		allNetlinks = append(allNetlinks, ns.netlinks...)
+		ns.netlinks = nil
+	}
+	sortNetlinks(allNetlinks)
+	allNetlinks = slices.CompactFunc(allNetlinks, func(a, b *ast.Struct) bool { return a.Name.Name == b.Name.Name })
+
+	// filterSendmsgPolicies must see every subsystem's sendmsg calls against the same
+	// global netlinks pool, and usedNetlink must accumulate across all of them before
+	// buildNetlinkUnion decides which policies still need a generic fallback entry.
+	usedNetlink := make(map[string]bool)
+	for _, ns := range bySubsystem {
+		ns.syscalls = filterSendmsgPolicies(ns.syscalls, allNetlinks, usedNetlink)
+	}
+	netlinkUnion := buildNetlinkUnion(allNetlinks, usedNetlink)
+
+	// The netlink policy structs and their msghdr_auto/auto_union/sendmsg$autorun
+	// fallback always go in the common file, so every subsystem file can reference them
+	// without redeclaring them - syzkaller's description compiler treats every .txt file
+	// in a directory as one compilation unit, so subsystem files need no explicit
+	// include to see them.
+	writeDescFile(common.includes, nil, nil, common.typeDefs, common.resources, netlinkUnion, filepath.Join(dir, commonSubsystemFile))
+
+	for _, subsystem := range subsystems {
+		ns := bySubsystem[subsystem]
+		out := filepath.Join(dir, subsystem+"_auto.txt")
+		writeDescFile(ns.includes, ns.syscalls, nil, ns.typeDefs, ns.resources, nil, out)
+	}
+}
+
+// writeDescFile sorts and dedups includes/syscalls the same way writeOutput does, sorts
+// netlinks/types/resources and drops duplicates of each by name (writeSubsystemOutput
+// hoists a shared node into the common file once per subsystem that defines it),
+// appends extra verbatim (used for the netlink union synthesized once for the common
+// file, see writeSubsystemOutput), then formats the result into a single description
+// file.
+func writeDescFile(includes []*ast.Include, syscalls []*ast.Call, netlinks []*ast.Struct, types []*ast.TypeDef,
+	resources []*ast.Resource, extra []ast.Node, outFile string) {
+	includes = sortAndDedupIncludes(includes)
+	syscalls = sortAndDedupSyscalls(syscalls)
+	sortNetlinks(netlinks)
+	netlinks = slices.CompactFunc(netlinks, func(a, b *ast.Struct) bool { return a.Name.Name == b.Name.Name })
+	sortResources(resources)
+	resources = slices.CompactFunc(resources, func(a, b *ast.Resource) bool { return a.Name.Name == b.Name.Name })
+	sortTypes(types)
+	types = slices.CompactFunc(types, func(a, b *ast.TypeDef) bool { return a.Name.Name == b.Name.Name })
+
+	eh := ast.LoggingHandler
+	desc := ast.Parse([]byte("# Code generated by syz-declextract. DO NOT EDIT.\n"), "", eh)
+	for _, node := range includes {
+		desc.Nodes = append(desc.Nodes, node)
+	}
+	for _, node := range resources {
+		desc.Nodes = append(desc.Nodes, node)
+	}
+	for _, node := range types {
+		desc.Nodes = append(desc.Nodes, node)
+	}
+	for _, node := range syscalls {
+		desc.Nodes = append(desc.Nodes, node)
+	}
+	for _, node := range netlinks {
+		desc.Nodes = append(desc.Nodes, node)
+	}
+	desc.Nodes = append(desc.Nodes, extra...)
+
+	// New lines are added in the parsing step. This is why we need to Format (serialize the description), Parse, then
+	// Format again.
+	if err := os.WriteFile(outFile, ast.Format(ast.Parse(ast.Format(desc), "", eh)), 0666); err != nil {
+		tool.Fail(err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+)
+
+func TestSubsystemFor(t *testing.T) {
+	rules := []subsystemRule{
+		{"drivers/net/wireless/", "wifi"},
+		{"drivers/net/", "drivers_net"},
+		{"net/ipv4/", "ipv4"},
+	}
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"net/ipv4/tcp_input.c", "ipv4"},
+		{"drivers/net/wireless/ath/ath9k.c", "wifi"},       // longest prefix wins over drivers/net/
+		{"drivers/net/ethernet/intel/e1000.c", "drivers_net"},
+		{"fs/ext4/inode.c", unknownSubsystem},
+	}
+	for _, test := range tests {
+		if got := subsystemFor(test.file, rules); got != test.want {
+			t.Errorf("subsystemFor(%q) = %q, want %q", test.file, got, test.want)
+		}
+	}
+}
+
+func TestLoadSubsystemOverridesLongestPrefixFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	if err := os.WriteFile(path, []byte(`{"drivers/net/": "drivers_net", "drivers/net/wireless/": "wifi"}`), 0644); err != nil {
+		t.Fatalf("writing overrides file: %v", err)
+	}
+	rules, err := loadSubsystemOverrides(path)
+	if err != nil {
+		t.Fatalf("loadSubsystemOverrides: %v", err)
+	}
+	if got := subsystemFor("drivers/net/wireless/ath/ath9k.c", rules); got != "wifi" {
+		t.Errorf("subsystemFor with overrides = %q, want %q (more specific prefix should win)", got, "wifi")
+	}
+}
+
+// TestWriteSubsystemOutputGroupsByFile is the scenario the process()/worker file
+// attribution bug (see process_test.go) broke completely: sharding only makes sense if
+// e.nodesByFile is keyed by the TU that actually produced each node.
+func TestWriteSubsystemOutputGroupsByFile(t *testing.T) {
+	eh := ast.LoggingHandler
+	parse := func(src string) []ast.Node { return ast.Parse([]byte(src), "", eh).Nodes }
+
+	e := &extraction{
+		split:          splitSubsystem,
+		subsystemRules: defaultSubsystemRules,
+		nodesByFile: map[string][]ast.Node{
+			"net/ipv4/tcp.c":    parse("resource shared_res[int32]\n"),
+			"drivers/net/eth.c": parse("resource shared_res[int32]\n"),
+			"fs/ext4/inode.c":   parse("resource fs_only_res[int32]\n"),
+		},
+	}
+
+	dir := t.TempDir()
+	e.writeOutput(filepath.Join(dir, "out.txt"))
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	ipv4 := read("ipv4_auto.txt")
+	driversNet := read("drivers_net_auto.txt")
+	fs := read("fs_auto.txt")
+	common := read("common_auto.txt")
+
+	if strings.Contains(ipv4, "shared_res") {
+		t.Errorf("ipv4_auto.txt should not redefine shared_res, got:\n%s", ipv4)
+	}
+	if strings.Contains(driversNet, "shared_res") {
+		t.Errorf("drivers_net_auto.txt should not redefine shared_res, got:\n%s", driversNet)
+	}
+	if !strings.Contains(common, "shared_res") {
+		t.Errorf("common_auto.txt should hoist shared_res (defined by both ipv4 and drivers_net), got:\n%s", common)
+	}
+	if !strings.Contains(fs, "fs_only_res") {
+		t.Errorf("fs_auto.txt should contain fs_only_res, got:\n%s", fs)
+	}
+	if strings.Contains(common, "fs_only_res") {
+		t.Errorf("common_auto.txt should not hoist fs_only_res, which only one subsystem defines, got:\n%s", common)
+	}
+}
+
+// TestWriteSubsystemOutputSynthesizesNetlinkUnion guards the netlink union writeOutput
+// synthesizes (msghdr_auto/auto_union/autogenerated_netlink/sendmsg$autorun): without it,
+// any subsystem file containing a sendmsg call references undefined types.
+func TestWriteSubsystemOutputSynthesizesNetlinkUnion(t *testing.T) {
+	eh := ast.LoggingHandler
+	parse := func(src string) []ast.Node { return ast.Parse([]byte(src), "", eh).Nodes }
+
+	e := &extraction{
+		split:          splitSubsystem,
+		subsystemRules: defaultSubsystemRules,
+		nodesByFile: map[string][]ast.Node{
+			// The policy struct is defined by a net/netlink TU...
+			"net/netlink/genetlink.c": parse("generic_netlink_policy {\n\tfield1\tint32\n}\n"),
+			// ...while the sendmsg call referencing it comes from an unrelated
+			// subsystem, exercising the cross-subsystem netlink lookup.
+			"drivers/net/eth.c": parse(
+				"sendmsg$foo(fd sock_nl_generic, msg ptr[in, msghdr_auto[_, generic_netlink_policy]], f flags[send_flags])\n"),
+		},
+	}
+
+	dir := t.TempDir()
+	e.writeOutput(filepath.Join(dir, "out.txt"))
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	common := read("common_auto.txt")
+	driversNet := read("drivers_net_auto.txt")
+
+	if !strings.Contains(common, "generic_netlink_policy") {
+		t.Errorf("common_auto.txt should contain the netlink policy struct, got:\n%s", common)
+	}
+	if !strings.Contains(common, "msghdr_auto") || !strings.Contains(common, "auto_union") {
+		t.Errorf("common_auto.txt should contain the synthesized msghdr_auto/auto_union declarations, got:\n%s", common)
+	}
+	if !strings.Contains(driversNet, "sendmsg$foo") {
+		t.Errorf("drivers_net_auto.txt should keep the sendmsg call now that its policy is resolvable, got:\n%s", driversNet)
+	}
+}
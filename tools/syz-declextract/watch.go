@@ -0,0 +1,160 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce bounds how long a burst of filesystem events (e.g. a build system
+// rewriting many headers in quick succession) is allowed to settle before triggering a
+// rerun, so that the burst causes one re-extraction instead of one per touched file.
+const watchDebounce = 500 * time.Millisecond
+
+// watchAndReextract watches the kernel source tree (and the compilation database) for
+// changes and incrementally re-extracts only the translation units affected by each
+// change, re-emitting outFile after every settled batch. It blocks until the watcher
+// is closed or errors out.
+func watchAndReextract(e *extraction, cmds []compileCommand, kernelDir, outFile, errorsPath string) error {
+	kernelDirAbs, err := filepath.Abs(kernelDir)
+	if err != nil {
+		return err
+	}
+	compilationDatabase, err := filepath.Abs(e.compilationDatabase)
+	if err != nil {
+		return err
+	}
+
+	// Compile command entries and the headers -M reports for them may be relative to
+	// cmd.Directory (and aren't necessarily relative to kernelDir at all), while
+	// fsnotify reports absolute paths derived from walking kernelDir. Resolve
+	// everything to absolute, cleaned paths so the two sides can be compared directly.
+	headerToFiles := make(map[string][]string)
+	for _, cmd := range cmds {
+		src := resolveSourcePath(cmd.Directory, cmd.File)
+		headerToFiles[src] = append(headerToFiles[src], cmd.File)
+		for _, h := range headerList(cmd.Directory, cmd.File, cmd.Arguments) {
+			abs := resolveSourcePath(cmd.Directory, h)
+			headerToFiles[abs] = append(headerToFiles[abs], cmd.File)
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := addRecursive(watcher, kernelDirAbs); err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(compilationDatabase)); err != nil {
+		return err
+	}
+
+	fmt.Printf("watching %v for changes\n", kernelDirAbs)
+
+	pending := make(map[string]bool)
+	var timer *time.Timer
+	resetTimer := func() {
+		if timer == nil {
+			timer = time.NewTimer(watchDebounce)
+			return
+		}
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(watchDebounce)
+	}
+	timerC := func() <-chan time.Time {
+		if timer == nil {
+			return nil
+		}
+		return timer.C
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			eventPath, err := filepath.Abs(event.Name)
+			if err != nil {
+				continue
+			}
+			if eventPath == compilationDatabase {
+				// The compile commands changed; the safest thing is to reprocess
+				// every known translation unit rather than guess what changed.
+				for _, cmd := range cmds {
+					pending[cmd.File] = true
+				}
+				resetTimer()
+				continue
+			}
+			if affected := headerToFiles[eventPath]; len(affected) > 0 {
+				for _, f := range affected {
+					pending[f] = true
+				}
+				resetTimer()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-timerC():
+			// The fired value has been consumed; the next event starts a fresh timer.
+			timer = nil
+			if len(pending) == 0 {
+				continue
+			}
+			files := make([]string, 0, len(pending))
+			for f := range pending {
+				files = append(files, f)
+			}
+			pending = make(map[string]bool)
+			fmt.Printf("re-extracting %d changed translation unit(s)\n", len(files))
+			e.process(files)
+			e.writeOutput(outFile)
+			if errorsPath != "" {
+				if err := e.writeErrorReport(errorsPath); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// resolveSourcePath turns a path from a compile command (or its -M header list), which
+// may be relative to that command's Directory, into an absolute, cleaned path
+// comparable against fsnotify event paths.
+func resolveSourcePath(directory, file string) string {
+	if filepath.IsAbs(file) {
+		return filepath.Clean(file)
+	}
+	return filepath.Clean(filepath.Join(directory, file))
+}
+
+// addRecursive adds every directory under root to the watcher, since fsnotify only
+// watches the directory it is given, not its subdirectories.
+func addRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}